@@ -0,0 +1,164 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	errFetchOIDCToken   = "failed to fetch OIDC access token"
+	errExchangeOIDCCode = "failed to exchange OIDC authorization code"
+)
+
+// An Authenticator supplies the bearer token the client presents to the
+// Upbound gateway. Implementations are free to cache and refresh the
+// token however they see fit; Token is called on every GetAgentCerts and
+// FetchNewJWTToken request.
+type Authenticator interface {
+	// Token returns a valid bearer token, refreshing it first if needed.
+	Token(ctx context.Context) (string, error)
+}
+
+// staticTokenAuthenticator always returns the same long-lived platform
+// token. It preserves the client's original behaviour for operators who
+// provision a static Upbound token per cluster rather than an IdP.
+type staticTokenAuthenticator struct {
+	token string
+}
+
+// NewStaticTokenAuthenticator returns an Authenticator that always returns
+// token, e.g. a long-lived Upbound platform token.
+func NewStaticTokenAuthenticator(token string) Authenticator {
+	return &staticTokenAuthenticator{token: token}
+}
+
+func (a *staticTokenAuthenticator) Token(_ context.Context) (string, error) {
+	return a.token, nil
+}
+
+// OIDCConfig configures an OIDC/OAuth2 token-exchange Authenticator. If
+// Code is set the authenticator performs a one-time authorization code
+// exchange; otherwise it performs a client-credentials exchange,
+// re-running it whenever the cached token expires.
+type OIDCConfig struct {
+	// IssuerURL is the base URL of the OIDC issuer/IdP, e.g. a Dex or
+	// Upbound Cloud SSO instance.
+	IssuerURL string
+
+	// TokenPath is appended to IssuerURL to form the token endpoint. It
+	// defaults to "/token".
+	TokenPath string
+
+	// ClientID and ClientSecret identify this agent to the issuer.
+	ClientID     string
+	ClientSecret string
+
+	// Scopes requested of the issuer.
+	Scopes []string
+
+	// Code and RedirectURL are set to use the authorization code flow
+	// instead of client-credentials, e.g. when a human operator has
+	// already completed the browser-based login.
+	Code        string
+	RedirectURL string
+}
+
+func (c OIDCConfig) tokenURL() string {
+	path := c.TokenPath
+	if path == "" {
+		path = "/token"
+	}
+	return strings.TrimSuffix(c.IssuerURL, "/") + path
+}
+
+// oidcAuthenticator is an Authenticator backed by an OAuth2 token
+// exchange. It caches the most recently fetched token in memory and
+// re-exchanges it once it is within its own expiry window. Refreshes use
+// the context passed to Token, not the one NewOIDCAuthenticator was
+// constructed with, so a caller's deadline or cancellation protects the
+// refresh request rather than only the initial exchange.
+type oidcAuthenticator struct {
+	mu      sync.Mutex
+	cur     *oauth2.Token
+	refresh func(ctx context.Context, cur *oauth2.Token) (*oauth2.Token, error)
+}
+
+// NewOIDCAuthenticator returns an Authenticator that exchanges client
+// credentials (or, if cfg.Code is set, an authorization code) for an
+// access token against cfg.IssuerURL, in the style of the OIDC connectors
+// dex ships for GitHub and other upstream IdPs. The resulting token is
+// cached in memory and refreshed before it expires. ctx governs only the
+// one-time authorization code exchange below; see oidcAuthenticator for
+// how later refreshes are scoped.
+func NewOIDCAuthenticator(ctx context.Context, cfg OIDCConfig) (Authenticator, error) {
+	if cfg.Code != "" {
+		oc := &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+			Endpoint:     oauth2.Endpoint{TokenURL: cfg.tokenURL()},
+		}
+
+		tok, err := oc.Exchange(ctx, cfg.Code)
+		if err != nil {
+			return nil, errors.Wrap(err, errExchangeOIDCCode)
+		}
+
+		return &oidcAuthenticator{
+			cur: tok,
+			refresh: func(ctx context.Context, cur *oauth2.Token) (*oauth2.Token, error) {
+				return oc.TokenSource(ctx, cur).Token()
+			},
+		}, nil
+	}
+
+	cc := &clientcredentials.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		TokenURL:     cfg.tokenURL(),
+		Scopes:       cfg.Scopes,
+	}
+
+	return &oidcAuthenticator{
+		refresh: func(ctx context.Context, _ *oauth2.Token) (*oauth2.Token, error) {
+			return cc.Token(ctx)
+		},
+	}, nil
+}
+
+func (a *oidcAuthenticator) Token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cur.Valid() {
+		return a.cur.AccessToken, nil
+	}
+
+	tok, err := a.refresh(ctx, a.cur)
+	if err != nil {
+		return "", errors.Wrap(err, errFetchOIDCToken)
+	}
+	a.cur = tok
+
+	return tok.AccessToken, nil
+}
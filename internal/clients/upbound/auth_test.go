@@ -0,0 +1,251 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"golang.org/x/oauth2"
+)
+
+func Test_StaticTokenAuthenticator(t *testing.T) {
+	a := NewStaticTokenAuthenticator("platform-token")
+
+	got, err := a.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token(...): unexpected error: %v", err)
+	}
+	if diff := cmp.Diff("platform-token", got); diff != "" {
+		t.Errorf("Token(...): -want, +got: %s", diff)
+	}
+}
+
+func Test_OIDCAuthenticatorClientCredentials(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodPost, "https://idp.example.com/token",
+		httpmock.NewJsonResponderOrPanic(http.StatusOK, map[string]interface{}{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		}))
+
+	a, err := NewOIDCAuthenticator(context.Background(), OIDCConfig{
+		IssuerURL:    "https://idp.example.com",
+		ClientID:     "agent",
+		ClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCAuthenticator(...): unexpected error: %v", err)
+	}
+
+	got, err := a.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token(...): unexpected error: %v", err)
+	}
+	if diff := cmp.Diff("test-access-token", got); diff != "" {
+		t.Errorf("Token(...): -want, +got: %s", diff)
+	}
+}
+
+func Test_OIDCAuthenticatorAuthorizationCode(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodPost, "https://idp.example.com/token",
+		httpmock.NewJsonResponderOrPanic(http.StatusOK, map[string]interface{}{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		}))
+
+	a, err := NewOIDCAuthenticator(context.Background(), OIDCConfig{
+		IssuerURL:    "https://idp.example.com",
+		ClientID:     "agent",
+		ClientSecret: "secret",
+		Code:         "test-authorization-code",
+		RedirectURL:  "https://agent.example/callback",
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCAuthenticator(...): unexpected error: %v", err)
+	}
+
+	got, err := a.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token(...): unexpected error: %v", err)
+	}
+	if diff := cmp.Diff("test-access-token", got); diff != "" {
+		t.Errorf("Token(...): -want, +got: %s", diff)
+	}
+}
+
+func Test_OIDCAuthenticatorRefreshesExpiredToken(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var calls int32
+	httpmock.RegisterResponder(http.MethodPost, "https://idp.example.com/token",
+		func(_ *http.Request) (*http.Response, error) {
+			n := atomic.AddInt32(&calls, 1)
+			return httpmock.NewJsonResponse(http.StatusOK, map[string]interface{}{
+				"access_token": fmt.Sprintf("test-access-token-%d", n),
+				"token_type":   "Bearer",
+				// oauth2 treats a token as expired if it's within 10
+				// seconds of Expiry, so expires_in: 1 is already expired
+				// by the time it's cached, forcing the next call to
+				// refresh rather than reuse it. expires_in: 0 would
+				// instead be read as "no expiry", which never refreshes.
+				"expires_in": 1,
+			})
+		})
+
+	a, err := NewOIDCAuthenticator(context.Background(), OIDCConfig{
+		IssuerURL:    "https://idp.example.com",
+		ClientID:     "agent",
+		ClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCAuthenticator(...): unexpected error: %v", err)
+	}
+
+	first, err := a.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token(...): unexpected error on initial fetch: %v", err)
+	}
+	if diff := cmp.Diff("test-access-token-1", first); diff != "" {
+		t.Errorf("Token(...): -want, +got: %s", diff)
+	}
+
+	second, err := a.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token(...): unexpected error on refresh: %v", err)
+	}
+	if diff := cmp.Diff("test-access-token-2", second); diff != "" {
+		t.Errorf("Token(...): -want, +got: %s", diff)
+	}
+}
+
+func Test_OIDCAuthenticatorRefreshError(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var calls int32
+	httpmock.RegisterResponder(http.MethodPost, "https://idp.example.com/token",
+		func(_ *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return httpmock.NewJsonResponse(http.StatusOK, map[string]interface{}{
+					"access_token": "test-access-token",
+					"token_type":   "Bearer",
+					"expires_in":   1, // already expired, forcing the next call to refresh
+				})
+			}
+			return httpmock.NewStringResponse(http.StatusInternalServerError, `{"error":"server_error"}`), nil
+		})
+
+	a, err := NewOIDCAuthenticator(context.Background(), OIDCConfig{
+		IssuerURL:    "https://idp.example.com",
+		ClientID:     "agent",
+		ClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCAuthenticator(...): unexpected error: %v", err)
+	}
+
+	if _, err := a.Token(context.Background()); err != nil {
+		t.Fatalf("Token(...): unexpected error on initial fetch: %v", err)
+	}
+
+	if _, err := a.Token(context.Background()); err == nil {
+		t.Fatal("Token(...): expected an error when the refresh request fails")
+	}
+}
+
+// ctxCheckingTransport is an http.RoundTripper that fails any request whose
+// context is already done, rather than actually performing it. It's used by
+// Test_OIDCAuthenticatorRefreshUsesPerCallContext below to prove which
+// context a refresh request carries, since httpmock's transport never looks
+// at the request context at all.
+type ctxCheckingTransport struct {
+	calls int32
+}
+
+func (t *ctxCheckingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt32(&t.calls, 1)
+	body, _ := json.Marshal(map[string]interface{}{
+		"access_token": "test-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   1, // already expired, forcing the next call to refresh
+	})
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// Test_OIDCAuthenticatorRefreshUsesPerCallContext guards against a refresh
+// silently using the context NewOIDCAuthenticator was constructed with
+// instead of the one passed to the Token call that triggered it. oauth2
+// resolves which *http.Client to use from a context value, so installing a
+// transport that checks its request's context on an otherwise-unrelated
+// construction-time context and an already-cancelled per-call context
+// proves which one actually reaches the refresh request.
+func Test_OIDCAuthenticatorRefreshUsesPerCallContext(t *testing.T) {
+	rt := &ctxCheckingTransport{}
+	httpClient := &http.Client{Transport: rt}
+
+	constructCtx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+
+	a, err := NewOIDCAuthenticator(constructCtx, OIDCConfig{
+		IssuerURL:    "https://idp.example.com",
+		ClientID:     "agent",
+		ClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCAuthenticator(...): unexpected error: %v", err)
+	}
+
+	warmCtx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	if _, err := a.Token(warmCtx); err != nil {
+		t.Fatalf("Token(...): unexpected error on initial fetch: %v", err)
+	}
+	if got := atomic.LoadInt32(&rt.calls); got != 1 {
+		t.Fatalf("expected 1 request after the initial fetch, got %d", got)
+	}
+
+	cancelledCtx, cancel := context.WithCancel(context.WithValue(context.Background(), oauth2.HTTPClient, httpClient))
+	cancel()
+
+	if _, err := a.Token(cancelledCtx); err == nil {
+		t.Fatal("Token(...): expected an error refreshing with an already-cancelled context")
+	}
+	if got := atomic.LoadInt32(&rt.calls); got != 1 {
+		t.Errorf("expected the cancelled-context refresh to never reach the transport, got %d requests", got)
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultRenewalFraction re-fetches the JWT once this fraction of its
+	// validity window has elapsed, leaving the remainder as a safety
+	// margin before the current credential actually expires.
+	defaultRenewalFraction = 2.0 / 3.0
+
+	defaultMinBackoff = 5 * time.Second
+	defaultMaxBackoff = 2 * time.Minute
+
+	// eventBacklog bounds how many unconsumed CredentialEvents are
+	// buffered for a subscriber; the manager does not block waiting for
+	// slow subscribers.
+	eventBacklog = 4
+
+	errFmtParseJWTExpiry = "failed to parse exp claim from jwt: %s"
+)
+
+// A CredentialEvent is emitted by a CredentialManager whenever it fetches
+// (or fails to fetch) a new JWT or, if certificate enrollment is enabled,
+// a new certificate.
+type CredentialEvent struct {
+	JWT         string
+	ExpiresAt   time.Time
+	Certificate *tls.Certificate
+	CertExpires time.Time
+	Err         error
+}
+
+// A CredentialManager owns the background renewal of a single cluster's
+// NATS JWT. Callers start it once at startup and read the current
+// credential via Current, or react to rotations via Subscribe.
+type CredentialManager struct {
+	client    Client
+	clusterID string
+	publicKey string
+	log       logging.Logger
+
+	renewalFraction float64
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	now             func() time.Time
+
+	// csrTemplate and enrollToken enable certificate rotation alongside
+	// JWT rotation; both are nil/empty unless WithCertificateEnrollment
+	// was passed to NewCredentialManager.
+	csrTemplate *x509.CertificateRequest
+	enrollToken string
+
+	mu            sync.RWMutex
+	jwt           string
+	expiresAt     time.Time
+	cert          *tls.Certificate
+	certExpiresAt time.Time
+	started       bool
+
+	events  chan CredentialEvent
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// A CredentialManagerOption configures a CredentialManager.
+type CredentialManagerOption func(*CredentialManager)
+
+// WithRenewalFraction sets the fraction of a JWT's validity window that
+// must elapse before it is renewed. It defaults to 2/3.
+func WithRenewalFraction(f float64) CredentialManagerOption {
+	return func(m *CredentialManager) { m.renewalFraction = f }
+}
+
+// WithBackoff sets the min and max backoff used between retries after a
+// failed renewal.
+func WithBackoff(min, max time.Duration) CredentialManagerOption { //nolint:predeclared // clearest names for this signature
+	return func(m *CredentialManager) {
+		m.minBackoff = min
+		m.maxBackoff = max
+	}
+}
+
+// WithCertificateEnrollment enables mTLS certificate rotation alongside
+// JWT rotation: the manager enrolls for a certificate from csrTemplate
+// using enrollToken, then keeps it fresh with Client.RenewCertificate,
+// using the same renewal fraction and backoff as the JWT but its own
+// timer.
+func WithCertificateEnrollment(enrollToken string, csrTemplate *x509.CertificateRequest) CredentialManagerOption {
+	return func(m *CredentialManager) {
+		m.enrollToken = enrollToken
+		m.csrTemplate = csrTemplate
+	}
+}
+
+// NewCredentialManager returns a CredentialManager that keeps the NATS
+// JWT for clusterID fresh, authenticating with client and presenting
+// publicKey as the NATS account key.
+func NewCredentialManager(client Client, clusterID, publicKey string, log logging.Logger, opts ...CredentialManagerOption) *CredentialManager {
+	m := &CredentialManager{
+		client:          client,
+		clusterID:       clusterID,
+		publicKey:       publicKey,
+		log:             log,
+		renewalFraction: defaultRenewalFraction,
+		minBackoff:      defaultMinBackoff,
+		maxBackoff:      defaultMaxBackoff,
+		now:             time.Now,
+		events:          make(chan CredentialEvent, eventBacklog),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// Start fetches an initial JWT (and, if certificate enrollment was
+// configured, an initial certificate) and, on success, launches a
+// background goroutine that renews them before they expire. It returns
+// the error from the initial fetch, if any; renewal failures after that
+// are reported via Subscribe rather than returned.
+func (m *CredentialManager) Start(ctx context.Context) error {
+	jwt, expiresAt, err := m.renew(ctx)
+	if err != nil {
+		return err
+	}
+	m.setCurrentJWT(jwt, expiresAt)
+
+	event := CredentialEvent{JWT: jwt, ExpiresAt: expiresAt}
+
+	if m.csrTemplate != nil {
+		cert, certExpiresAt, err := m.enroll()
+		if err != nil {
+			return err
+		}
+		m.setCurrentCert(cert, certExpiresAt)
+		event.Certificate, event.CertExpires = cert, certExpiresAt
+	}
+
+	m.emit(event)
+
+	m.mu.Lock()
+	m.started = true
+	m.mu.Unlock()
+
+	go m.run(ctx)
+
+	return nil
+}
+
+// Stop ends the background renewal goroutine and waits for it to exit. It
+// is always safe to call, including when Start returned an error or was
+// never called, in which case there is no goroutine to wait for and Stop
+// returns immediately.
+func (m *CredentialManager) Stop() {
+	m.once.Do(func() { close(m.stop) })
+
+	m.mu.RLock()
+	started := m.started
+	m.mu.RUnlock()
+	if !started {
+		return
+	}
+
+	<-m.stopped
+}
+
+// Current returns the most recently fetched JWT and its expiry time.
+func (m *CredentialManager) Current() (jwt string, expiresAt time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.jwt, m.expiresAt
+}
+
+// CurrentCertificate returns the most recently enrolled certificate and
+// its expiry time. It is only populated if WithCertificateEnrollment was
+// passed to NewCredentialManager.
+func (m *CredentialManager) CurrentCertificate() (cert *tls.Certificate, expiresAt time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert, m.certExpiresAt
+}
+
+// Subscribe returns a channel of CredentialEvents, one per renewal
+// attempt (successful or not). Every call returns the same channel, and
+// it is never closed, not even by Stop. It is buffered so a slow
+// subscriber does not stall renewal; events that do not fit are dropped.
+func (m *CredentialManager) Subscribe() <-chan CredentialEvent {
+	return m.events
+}
+
+// run drives renewal of the JWT and, if enabled, the certificate. Each
+// credential tracks its own "next attempt" time and backoff
+// independently: a schedule slips only for the credential that just
+// failed, rather than a shared clock that a single failure would throw
+// off for everything.
+func (m *CredentialManager) run(ctx context.Context) {
+	defer close(m.stopped)
+
+	_, jwtExpiresAt := m.Current()
+	nextJWT := m.now().Add(m.renewalDelay(jwtExpiresAt))
+	jwtBackoff := m.minBackoff
+
+	var nextCert time.Time
+	certBackoff := m.minBackoff
+	if m.csrTemplate != nil {
+		_, certExpiresAt := m.CurrentCertificate()
+		nextCert = m.now().Add(m.renewalDelay(certExpiresAt))
+	}
+
+	for {
+		wait, dueJWT, dueCert := nextJWT.Sub(m.now()), true, false
+		if m.csrTemplate != nil {
+			if certWait := nextCert.Sub(m.now()); certWait < wait {
+				wait, dueJWT, dueCert = certWait, false, true
+			} else if certWait == wait {
+				dueCert = true
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		case <-m.stop:
+			return
+		}
+
+		event := CredentialEvent{}
+
+		if dueJWT {
+			jwt, expiresAt, err := m.renew(ctx)
+			if err != nil {
+				event.Err = err
+				nextJWT = m.now().Add(jitter(jwtBackoff))
+				jwtBackoff = minDuration(jwtBackoff*2, m.maxBackoff)
+			} else {
+				m.setCurrentJWT(jwt, expiresAt)
+				event.JWT, event.ExpiresAt = jwt, expiresAt
+				nextJWT = m.now().Add(m.renewalDelay(expiresAt))
+				jwtBackoff = m.minBackoff
+			}
+		}
+
+		if dueCert {
+			cert, expiresAt, err := m.renewCert(ctx)
+			if err != nil {
+				if event.Err == nil {
+					event.Err = err
+				}
+				nextCert = m.now().Add(jitter(certBackoff))
+				certBackoff = minDuration(certBackoff*2, m.maxBackoff)
+			} else {
+				m.setCurrentCert(cert, expiresAt)
+				event.Certificate, event.CertExpires = cert, expiresAt
+				nextCert = m.now().Add(m.renewalDelay(expiresAt))
+				certBackoff = m.minBackoff
+			}
+		}
+
+		m.emit(event)
+	}
+}
+
+func (m *CredentialManager) renew(ctx context.Context) (jwt string, expiresAt time.Time, err error) {
+	jwt, err = m.client.FetchNewJWTToken(ctx, m.clusterID, m.publicKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt, err = jwtExpiry(jwt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return jwt, expiresAt, nil
+}
+
+func (m *CredentialManager) enroll() (cert *tls.Certificate, expiresAt time.Time, err error) {
+	result, err := m.client.EnrollWithCSR(m.enrollToken, m.csrTemplate)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return &result.Certificate, certExpiry(&result.Certificate), nil
+}
+
+func (m *CredentialManager) renewCert(_ context.Context) (cert *tls.Certificate, expiresAt time.Time, err error) {
+	current, _ := m.CurrentCertificate()
+
+	result, err := m.client.RenewCertificate(current)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return &result.Certificate, certExpiry(&result.Certificate), nil
+}
+
+func (m *CredentialManager) renewalDelay(expiresAt time.Time) time.Duration {
+	if expiresAt.IsZero() {
+		return 0
+	}
+	ttl := expiresAt.Sub(m.now())
+	d := time.Duration(float64(ttl) * m.renewalFraction)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (m *CredentialManager) setCurrentJWT(jwt string, expiresAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jwt = jwt
+	m.expiresAt = expiresAt
+}
+
+func (m *CredentialManager) setCurrentCert(cert *tls.Certificate, expiresAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cert = cert
+	m.certExpiresAt = expiresAt
+}
+
+// certExpiry returns a certificate's NotAfter time, parsing the leaf if
+// it was not already attached by tls.X509KeyPair.
+func certExpiry(cert *tls.Certificate) time.Time {
+	if cert.Leaf != nil {
+		return cert.Leaf.NotAfter
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}
+	}
+	return leaf.NotAfter
+}
+
+func (m *CredentialManager) emit(e CredentialEvent) {
+	select {
+	case m.events <- e:
+	default:
+		m.log.Debug("dropping credential event, subscriber is not keeping up")
+	}
+}
+
+// jitter returns d plus or minus up to 20%, so that many agents renewing
+// around the same time don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	spread := float64(d) * 0.2
+	return d + time.Duration(spread*(rand.Float64()*2-1)) //nolint:gosec // jitter has no security relevance
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// jwtExpiry returns the time.Time corresponding to the "exp" claim of a
+// compact JWT, without verifying its signature; the manager only uses it
+// to schedule a renewal and always re-fetches from a trusted endpoint.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.Errorf(errFmtParseJWTExpiry, "malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, errFmtParseJWTExpiry, "payload is not valid base64")
+	}
+
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, errors.Wrapf(err, errFmtParseJWTExpiry, "payload is not valid JSON")
+	}
+
+	if claims.Exp == 0 {
+		return time.Time{}, errors.Errorf(errFmtParseJWTExpiry, "no exp claim present")
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
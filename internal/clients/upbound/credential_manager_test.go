@@ -0,0 +1,316 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/google/uuid"
+	"github.com/jarcoal/httpmock"
+	"github.com/pkg/errors"
+)
+
+func testJWT(t *testing.T, expiresAt time.Time) string {
+	t.Helper()
+
+	payload, err := json.Marshal(struct {
+		Exp int64 `json:"exp"`
+	}{Exp: expiresAt.Unix()})
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+
+	return fmt.Sprintf("%s.%s.%s",
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)),
+		base64.RawURLEncoding.EncodeToString(payload),
+		base64.RawURLEncoding.EncodeToString([]byte("sig")))
+}
+
+func Test_CredentialManagerRenewsBeforeExpiry(t *testing.T) {
+	endpoint := "https://foo.com"
+	clusterID := uuid.New().String()
+
+	rc := NewClient(endpoint, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"))
+	httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+	defer httpmock.DeactivateAndReset()
+
+	// The exp claim is second-granularity, like a real JWT, so the TTL
+	// needs to be large enough that truncation to the nearest second
+	// can't make a freshly issued token look already expired.
+	const ttl = 2 * time.Second
+
+	var fetches int32
+	httpmock.RegisterResponder(http.MethodPost, endpoint+natsTokenPath, func(_ *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&fetches, 1)
+		jwt := testJWT(t, time.Now().Add(ttl))
+		return httpmock.NewJsonResponse(http.StatusOK, map[string]string{"token": jwt})
+	})
+
+	m := NewCredentialManager(rc, clusterID, "some-public-key", logging.NewNopLogger(),
+		WithRenewalFraction(0.5))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("Start(...): unexpected error: %v", err)
+	}
+	defer m.Stop()
+
+	events := m.Subscribe()
+
+	// The first event on the channel is the initial fetch done by Start;
+	// the renewal, scheduled at 0.5 * ttl, is the second one. Assert it
+	// actually landed before the original token's expiry.
+	var originalExpiry time.Time
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			if e.Err != nil {
+				t.Fatalf("unexpected renewal error: %v", e.Err)
+			}
+			if i == 0 {
+				originalExpiry = e.ExpiresAt
+			}
+			if i == 1 && !time.Now().Before(originalExpiry) {
+				t.Errorf("renewal landed after the original credential expired")
+			}
+			if i == 1 && e.ExpiresAt.Before(time.Now()) {
+				t.Errorf("renewed credential is already expired")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for renewal")
+		}
+	}
+
+	if got := atomic.LoadInt32(&fetches); got < 2 {
+		t.Errorf("expected at least 2 fetches (initial + renewal), got %d", got)
+	}
+}
+
+func Test_CredentialManagerRetriesWithBoundedBackoff(t *testing.T) {
+	endpoint := "https://foo.com"
+	clusterID := uuid.New().String()
+
+	rc := NewClient(endpoint, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"))
+	httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+	defer httpmock.DeactivateAndReset()
+
+	var calls int32
+	httpmock.RegisterResponder(http.MethodPost, endpoint+natsTokenPath, func(_ *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			// Initial fetch, used to get Start past the door.
+			jwt := testJWT(t, time.Now().Add(time.Second))
+			return httpmock.NewJsonResponse(http.StatusOK, map[string]string{"token": jwt})
+		}
+		// Every renewal after that fails transiently.
+		return nil, errors.New("boom")
+	})
+
+	m := NewCredentialManager(rc, clusterID, "some-public-key", logging.NewNopLogger(),
+		WithRenewalFraction(0.5),
+		WithBackoff(10*time.Millisecond, 20*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("Start(...): unexpected error: %v", err)
+	}
+	defer m.Stop()
+
+	events := m.Subscribe()
+
+	var sawErr bool
+	deadline := time.After(3 * time.Second)
+	for !sawErr {
+		select {
+		case e := <-events:
+			if e.Err != nil {
+				sawErr = true
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for a failed renewal event")
+		}
+	}
+
+	// The manager must keep retrying rather than giving up after one
+	// failure - a few backoff cycles should produce several more calls.
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got < 3 {
+		t.Errorf("expected bounded retries to keep calling the endpoint, got %d calls", got)
+	}
+}
+
+// Test_CredentialManagerStopAfterFailedStart guards against Stop blocking
+// forever when Start's initial fetch failed, since run (and the close of
+// m.stopped it defers) is never launched in that case.
+func Test_CredentialManagerStopAfterFailedStart(t *testing.T) {
+	endpoint := "https://foo.com"
+	clusterID := uuid.New().String()
+
+	rc := NewClient(endpoint, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"))
+	httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder(http.MethodPost, endpoint+natsTokenPath, httpmock.NewErrorResponder(errors.New("boom")))
+
+	m := NewCredentialManager(rc, clusterID, "some-public-key", logging.NewNopLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.Start(ctx); err == nil {
+		t.Fatal("Start(...): expected an error from the failing initial fetch")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop() did not return after a failed Start()")
+	}
+}
+
+// Test_CredentialManagerStopWithoutStart guards against Stop blocking
+// forever when it is called without Start ever having been called.
+func Test_CredentialManagerStopWithoutStart(t *testing.T) {
+	rc := NewClient("https://foo.com", logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"))
+	m := NewCredentialManager(rc, uuid.New().String(), "some-public-key", logging.NewNopLogger())
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop() did not return when Start() was never called")
+	}
+}
+
+// Test_CredentialManagerRotatesCertificate exercises WithCertificateEnrollment
+// end to end: Start must enroll an initial certificate alongside the JWT,
+// and run must keep both on their own schedule, renewing the certificate
+// via RenewCertificate once it nears expiry. RenewCertificate builds its
+// own resty client rather than using client.resty, so it can't be mocked
+// with httpmock the way the JWT and enrollment paths can be; a real
+// httptest.Server serves all three paths instead.
+func Test_CredentialManagerRotatesCertificate(t *testing.T) {
+	clusterID := uuid.New().String()
+	csrTemplate := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "agent.example"}}
+
+	// Second-granularity, like the JWT TTLs elsewhere in this file: short
+	// enough to exercise renewal promptly, long enough that truncation
+	// can't make a freshly issued credential look already expired.
+	const certTTL = 2 * time.Second
+
+	var enrollCalls, renewCalls int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(gwEnrollPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&enrollCalls, 1)
+		signCSRHandler(t, certTTL)(w, r)
+	})
+	mux.HandleFunc(gwEnrollRenewPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&renewCalls, 1)
+		signCSRHandler(t, certTTL)(w, r)
+	})
+	mux.HandleFunc(natsTokenPath, func(w http.ResponseWriter, r *http.Request) {
+		jwt := testJWT(t, time.Now().Add(certTTL))
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": jwt})
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	rc := NewClient(srv.URL, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"))
+
+	m := NewCredentialManager(rc, clusterID, "some-public-key", logging.NewNopLogger(),
+		WithRenewalFraction(0.5),
+		WithCertificateEnrollment("enroll-token", csrTemplate))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("Start(...): unexpected error: %v", err)
+	}
+	defer m.Stop()
+
+	if cert, expiresAt := m.CurrentCertificate(); cert == nil || expiresAt.IsZero() {
+		t.Fatal("Start(...) did not enroll an initial certificate")
+	}
+
+	events := m.Subscribe()
+	deadline := time.After(5 * time.Second)
+
+	// The first event is the initial JWT+certificate issued by Start.
+	select {
+	case e := <-events:
+		if e.Err != nil {
+			t.Fatalf("unexpected initial event error: %v", e.Err)
+		}
+	case <-deadline:
+		t.Fatal("timed out waiting for the initial credential event")
+	}
+
+	// JWT and certificate renewals are scheduled independently and may be
+	// interleaved, so keep reading until a certificate renewal shows up
+	// rather than assuming it's the very next event.
+	var renewed bool
+	for !renewed {
+		select {
+		case e := <-events:
+			if e.Err != nil {
+				t.Fatalf("unexpected renewal error: %v", e.Err)
+			}
+			if e.Certificate != nil {
+				renewed = true
+				if e.CertExpires.Before(time.Now()) {
+					t.Errorf("renewed certificate is already expired")
+				}
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for certificate renewal")
+		}
+	}
+
+	if got := atomic.LoadInt32(&enrollCalls); got != 1 {
+		t.Errorf("expected exactly 1 enrollment call, got %d", got)
+	}
+	if got := atomic.LoadInt32(&renewCalls); got < 1 {
+		t.Errorf("expected at least 1 certificate renewal call, got %d", got)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"github.com/pkg/errors"
+)
+
+// signCSR parses a PEM-encoded CSR and returns a freshly minted leaf
+// certificate (signed by an on-the-fly test CA, valid for ttl) for its
+// public key, plus the CA bundle, mimicking what a real enrollment
+// endpoint would hand back.
+func signCSR(t *testing.T, csrPEM []byte, ttl time.Duration) (certPEM, caPEM []byte) {
+	t.Helper()
+
+	block, _ := pem.Decode(csrPEM)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse csr: %v", err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ca key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-ca"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create ca certificate: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("parse ca certificate: %v", err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(ttl),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create leaf certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: pemBlockCertificate, Bytes: leafDER}),
+		pem.EncodeToMemory(&pem.Block{Type: pemBlockCertificate, Bytes: caDER})
+}
+
+// signCSRResponder is a signCSR-backed httpmock.Responder, for testing
+// paths that go through client.resty and so can be mocked with httpmock.
+func signCSRResponder(t *testing.T) httpmock.Responder {
+	t.Helper()
+
+	return func(req *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		var payload map[string]string
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+
+		certPEM, caPEM := signCSR(t, []byte(payload["csr"]), time.Hour)
+
+		return httpmock.NewJsonResponse(http.StatusOK, map[string]string{
+			keyCertificate: string(certPEM),
+			keyCABundle:    string(caPEM),
+		})
+	}
+}
+
+// signCSRHandler is a signCSR-backed http.HandlerFunc, for testing paths
+// like RenewCertificate that build their own resty client and so can't be
+// mocked with httpmock; it is served from a real httptest.Server instead.
+func signCSRHandler(t *testing.T, ttl time.Duration) http.HandlerFunc {
+	t.Helper()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("read request body: %v", err)
+		}
+
+		var payload map[string]string
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatalf("unmarshal request body: %v", err)
+		}
+
+		certPEM, caPEM := signCSR(t, []byte(payload["csr"]), ttl)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{
+			keyCertificate: string(certPEM),
+			keyCABundle:    string(caPEM),
+		}); err != nil {
+			t.Fatalf("encode response: %v", err)
+		}
+	}
+}
+
+// testLeafCertificate returns a self-signed certificate usable as the
+// currentCert argument to RenewCertificate.
+func testLeafCertificate(t *testing.T, commonName string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func Test_EnrollWithCSR(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	endpoint := "https://foo.com"
+	token := "platform-token"
+	csrTemplate := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "agent.example"}}
+
+	type args struct {
+		responder    httpmock.Responder
+		responderErr error
+		responseCode int
+		responseBody interface{}
+	}
+	type want struct {
+		err error
+	}
+	cases := map[string]struct {
+		args
+		want
+	}{
+		"Success": {
+			args: args{responder: signCSRResponder(t)},
+			want: want{err: nil},
+		},
+		"ServerError": {
+			args: args{
+				responseCode: http.StatusInternalServerError,
+				responseBody: "some-error",
+			},
+			want: want{
+				err: errors.New("enroll request failed with 500 - \"some-error\""),
+			},
+		},
+		"MalformedCertificatePEM": {
+			args: args{
+				responseCode: http.StatusOK,
+				responseBody: map[string]string{
+					keyCertificate: "not-a-pem-block",
+					keyCABundle:    "not-a-pem-block",
+				},
+			},
+			want: want{
+				err: errors.New(errDecodeCertificatePEM),
+			},
+		},
+		"RestyTransportErr": {
+			args: args{
+				responderErr: errBoom,
+			},
+			want: want{
+				err: errors.Wrap(&url.Error{
+					Op:  "Post",
+					URL: "https://foo.com/v1/gw/enroll",
+					Err: errBoom,
+				}, errRequestEnroll),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rc := NewClient(endpoint, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator(token))
+
+			httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+			defer httpmock.DeactivateAndReset()
+
+			responder := tc.args.responder
+			if responder == nil {
+				if tc.responderErr != nil {
+					responder = httpmock.NewErrorResponder(tc.responderErr)
+				} else {
+					b, err := json.Marshal(tc.responseBody)
+					if err != nil {
+						t.Fatalf("cannot marshal tc.responseBody: %v", err)
+					}
+					responder = httpmock.NewStringResponder(tc.responseCode, string(b))
+				}
+			}
+
+			httpmock.RegisterResponder(http.MethodPost, endpoint+gwEnrollPath, responder)
+
+			got, gotErr := rc.EnrollWithCSR(token, csrTemplate)
+			if diff := cmp.Diff(tc.want.err, gotErr, test.EquateErrors()); diff != "" {
+				t.Fatalf("EnrollWithCSR(...): -want error, +got error: %s", diff)
+			}
+			if tc.want.err == nil && got == nil {
+				t.Errorf("EnrollWithCSR(...): expected a non-nil result on success")
+			}
+		})
+	}
+}
+
+func Test_RenewCertificate(t *testing.T) {
+	currentCert := testLeafCertificate(t, "agent.example")
+
+	type want struct {
+		err         error
+		errContains string
+	}
+	cases := map[string]struct {
+		handler  http.HandlerFunc
+		closeSrv bool
+		want     want
+	}{
+		"Success": {
+			handler: signCSRHandler(t, time.Hour),
+		},
+		"ServerError": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`"some-error"`))
+			},
+			want: want{err: errors.New("renew request failed with 500 - \"some-error\"")},
+		},
+		"MalformedCertificatePEM": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(map[string]string{
+					keyCertificate: "not-a-pem-block",
+					keyCABundle:    "not-a-pem-block",
+				})
+			},
+			want: want{err: errors.New(errDecodeCertificatePEM)},
+		},
+		"RestyTransportErr": {
+			// RenewCertificate builds its own resty client, so it can't
+			// be exercised through httpmock and every case here runs
+			// against a real server; close the server before the
+			// request to force a transport error instead.
+			closeSrv: true,
+			want:     want{errContains: errRequestRenew},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			if tc.closeSrv {
+				srv.Close()
+			} else {
+				defer srv.Close()
+			}
+
+			rc := NewClient(srv.URL, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"))
+
+			got, gotErr := rc.RenewCertificate(currentCert)
+
+			if tc.want.errContains != "" {
+				if gotErr == nil || !strings.Contains(gotErr.Error(), tc.want.errContains) {
+					t.Fatalf("RenewCertificate(...): got error %v, want it to contain %q", gotErr, tc.want.errContains)
+				}
+				return
+			}
+
+			if diff := cmp.Diff(tc.want.err, gotErr, test.EquateErrors()); diff != "" {
+				t.Fatalf("RenewCertificate(...): -want error, +got error: %s", diff)
+			}
+			if tc.want.err == nil && got == nil {
+				t.Errorf("RenewCertificate(...): expected a non-nil result on success")
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Error kinds recorded against Metrics' failure counter. They cover both
+// errors resty surfaces itself (transport, non-2xx) and ones the client
+// only discovers once it looks at a successful response (decode,
+// empty-response).
+const (
+	ErrKindTransport     = "transport"
+	ErrKindNon2xx        = "non_2xx"
+	ErrKindDecode        = "decode"
+	ErrKindEmptyResponse = "empty_response"
+)
+
+// Metrics holds the Prometheus collectors the upbound client reports
+// against. Pass the result of NewMetrics to NewClient via WithMetrics to
+// enable instrumentation; a nil *Metrics (the default) is a no-op.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	jwtTTL   *prometheus.GaugeVec
+}
+
+// NewMetrics constructs a Metrics. Call MustRegister to register its
+// collectors with a Prometheus registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "upbound",
+			Subsystem: "agent",
+			Name:      "gateway_requests_total",
+			Help:      "Total number of requests made to the Upbound gateway.",
+		}, []string{"endpoint", "method", "status_class"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "upbound",
+			Subsystem: "agent",
+			Name:      "gateway_request_duration_seconds",
+			Help:      "Latency of requests made to the Upbound gateway.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint", "method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "upbound",
+			Subsystem: "agent",
+			Name:      "gateway_request_errors_total",
+			Help:      "Total number of failed requests to the Upbound gateway, by error kind.",
+		}, []string{"endpoint", "kind"}),
+		jwtTTL: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "upbound",
+			Subsystem: "agent",
+			Name:      "nats_jwt_expiry_seconds",
+			Help:      "Seconds until the current NATS JWT expires.",
+		}, []string{"cluster_id"}),
+	}
+}
+
+// MustRegister registers all of Metrics' collectors with reg, panicking
+// if any are already registered.
+func (m *Metrics) MustRegister(reg prometheus.Registerer) {
+	reg.MustRegister(m.requests, m.latency, m.errors, m.jwtTTL)
+}
+
+// install wires m's request/response middleware into r. It is a no-op if
+// m is nil, so callers need not guard every call site.
+func (m *Metrics) install(r *resty.Client) {
+	if m == nil {
+		return
+	}
+
+	r.OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+		endpoint := requestPath(resp.Request)
+		m.latency.WithLabelValues(endpoint, resp.Request.Method).Observe(resp.Time().Seconds())
+		m.requests.WithLabelValues(endpoint, resp.Request.Method, statusClass(resp.StatusCode())).Inc()
+
+		if resp.IsError() {
+			m.errors.WithLabelValues(endpoint, ErrKindNon2xx).Inc()
+		}
+
+		return nil
+	})
+
+	r.OnError(func(req *resty.Request, err error) {
+		m.errors.WithLabelValues(requestPath(req), ErrKindTransport).Inc()
+	})
+}
+
+// recordError records a failure that the client only detects once it has
+// a successful response in hand, e.g. a response body that doesn't
+// decode or is missing the field the client needs. It is a no-op if m is
+// nil.
+func (m *Metrics) recordError(endpoint, kind string) {
+	if m == nil {
+		return
+	}
+	m.errors.WithLabelValues(endpoint, kind).Inc()
+}
+
+// observeJWTExpiry records the number of seconds until the JWT most
+// recently fetched for clusterID expires. It is a no-op if m is nil.
+func (m *Metrics) observeJWTExpiry(clusterID string, expiresAt time.Time) {
+	if m == nil {
+		return
+	}
+	m.jwtTTL.WithLabelValues(clusterID).Set(time.Until(expiresAt).Seconds())
+}
+
+func statusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// requestPath returns the path component of req's URL, e.g. gwCertsPath,
+// so it can be used as a low-cardinality metric label instead of the
+// full URL.
+func requestPath(req *resty.Request) string {
+	if req == nil || req.RawRequest == nil {
+		return ""
+	}
+	return req.RawRequest.URL.Path
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upbound
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/jarcoal/httpmock"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c *Metrics, name string, labels prometheus.Labels) float64 {
+	t.Helper()
+
+	var vec *prometheus.CounterVec
+	switch name {
+	case "requests":
+		vec = c.requests
+	case "errors":
+		vec = c.errors
+	default:
+		t.Fatalf("unknown counter %q", name)
+	}
+
+	m := &dto.Metric{}
+	if err := vec.With(labels).Write(m); err != nil {
+		t.Fatalf("Write(...): unexpected error: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func Test_MetricsRecordSuccessAndFailure(t *testing.T) {
+	endpoint := "https://foo.com"
+	m := NewMetrics()
+
+	rc := NewClient(endpoint, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"), WithMetrics(m))
+
+	httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
+	defer httpmock.DeactivateAndReset()
+
+	certsBody, err := json.Marshal(map[string]string{
+		keyNATSCA:       "test-ca",
+		keyJWTPublicKey: "test-jwt-public-key",
+	})
+	if err != nil {
+		t.Fatalf("marshal certs body: %v", err)
+	}
+	httpmock.RegisterResponder(http.MethodGet, endpoint+gwCertsPath, httpmock.NewStringResponder(http.StatusOK, string(certsBody)))
+
+	if _, err := rc.GetAgentCerts(context.Background()); err != nil {
+		t.Fatalf("GetAgentCerts(...): unexpected error: %v", err)
+	}
+
+	if got := counterValue(t, m, "requests", prometheus.Labels{"endpoint": gwCertsPath, "method": http.MethodGet, "status_class": "2xx"}); got != 1 {
+		t.Errorf("requests counter for GetAgentCerts: got %v, want 1", got)
+	}
+
+	httpmock.RegisterResponder(http.MethodPost, endpoint+natsTokenPath, httpmock.NewErrorResponder(errors.New("boom")))
+
+	if _, err := rc.FetchNewJWTToken(context.Background(), "cluster-id", "some-public-key"); err == nil {
+		t.Fatal("FetchNewJWTToken(...): expected an error")
+	}
+
+	if got := counterValue(t, m, "errors", prometheus.Labels{"endpoint": natsTokenPath, "kind": ErrKindTransport}); got != 1 {
+		t.Errorf("error counter for FetchNewJWTToken: got %v, want 1", got)
+	}
+}
+
+// Test_MetricsRecordsCertificateRenewal guards against RenewCertificate's
+// mtls client going uninstrumented: it builds its own resty client rather
+// than using client.resty, so it can't be exercised through httpmock like
+// Test_MetricsRecordSuccessAndFailure above and instead runs against a real
+// httptest.Server, as Test_RenewCertificate in enroll_test.go does.
+func Test_MetricsRecordsCertificateRenewal(t *testing.T) {
+	currentCert := testLeafCertificate(t, "agent.example")
+	m := NewMetrics()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			keyCertificate: "not-a-pem-block",
+			keyCABundle:    "not-a-pem-block",
+		})
+	}))
+	defer srv.Close()
+
+	rc := NewClient(srv.URL, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator("platform-token"), WithMetrics(m))
+
+	if _, err := rc.RenewCertificate(currentCert); err == nil {
+		t.Fatal("RenewCertificate(...): expected an error decoding a malformed certificate PEM")
+	}
+
+	if got := counterValue(t, m, "requests", prometheus.Labels{"endpoint": gwEnrollRenewPath, "method": http.MethodPost, "status_class": "2xx"}); got != 1 {
+		t.Errorf("requests counter for RenewCertificate: got %v, want 1", got)
+	}
+	if got := counterValue(t, m, "errors", prometheus.Labels{"endpoint": gwEnrollRenewPath, "kind": ErrKindDecode}); got != 1 {
+		t.Errorf("error counter for RenewCertificate: got %v, want 1", got)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2021 Upbound Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package upbound contains a client for talking to the Upbound gateway,
+// used by the agent to fetch the certificates and tokens it needs to
+// connect to the Upbound NATS control plane.
+package upbound
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	gwCertsPath   = "/v1/gw/certs"
+	natsTokenPath = "/v1/nats/token"
+
+	keyNATSCA       = "nats_ca"
+	keyJWTPublicKey = "jwt_public_key"
+	keyToken        = "token"
+
+	errFmtAgentCertsRequestFailed = "agent certs request failed with %d - %s"
+	errFmtNewTokenRequestFailed   = "new token request failed with %d - %s"
+	errUnmarshalAgentCerts        = "failed to unmarshall agent certs response"
+	errUnmarshalNATSToken         = "failed to unmarshall nats token response"
+	errEmptyJWTPublicKey          = "empty jwt public key received"
+	errEmptyToken                 = "empty token received"
+	errRequestAgentCerts          = "failed to request agent certs"
+	errRequestNewToken            = "failed to request new token"
+)
+
+// PublicCerts holds the public material the agent needs to validate and
+// join the Upbound NATS control plane.
+type PublicCerts struct {
+	NATSCA       string
+	JWTPublicKey string
+}
+
+// Client is a client for the Upbound gateway.
+type Client interface {
+	// GetAgentCerts fetches the NATS CA and JWT public key used to
+	// validate the control plane.
+	GetAgentCerts(ctx context.Context) (PublicCerts, error)
+
+	// FetchNewJWTToken fetches a new NATS JWT for clusterID, presenting
+	// publicKey as the NATS account key.
+	FetchNewJWTToken(ctx context.Context, clusterID, publicKey string) (string, error)
+
+	// EnrollWithCSR generates a keypair, submits a CSR built from csr to
+	// the gateway's enrollment endpoint authenticating with token, and
+	// returns the signed certificate and CA bundle it is handed back.
+	EnrollWithCSR(token string, csr *x509.CertificateRequest) (*EnrollmentResult, error)
+
+	// RenewCertificate uses mTLS with currentCert to request a new
+	// certificate for the same identity before currentCert expires.
+	RenewCertificate(currentCert *tls.Certificate) (*EnrollmentResult, error)
+}
+
+// client is a resty backed implementation of Client.
+type client struct {
+	log                   logging.Logger
+	resty                 *resty.Client
+	auth                  Authenticator
+	endpoint              string
+	insecureSkipTLSVerify bool
+	metrics               *Metrics
+}
+
+// A ClientOption configures optional behaviour of a Client.
+type ClientOption func(*client)
+
+// WithMetrics registers m's collectors as resty middleware on the client,
+// so every request updates its request count, latency and error metrics.
+func WithMetrics(m *Metrics) ClientOption {
+	return func(c *client) { c.metrics = m }
+}
+
+// NewClient builds a Client that talks to the Upbound gateway at endpoint,
+// authenticating requests with auth. Pass a NewStaticTokenAuthenticator to
+// authenticate with a long-lived platform token, or a NewOIDCAuthenticator
+// to exchange and rotate credentials against an external IdP.
+func NewClient(endpoint string, log logging.Logger, insecureSkipTLSVerify bool, debug bool, auth Authenticator, opts ...ClientOption) Client {
+	r := resty.New().
+		SetBaseURL(endpoint).
+		SetDebug(debug).
+		SetTLSClientConfig(&tls.Config{InsecureSkipVerify: insecureSkipTLSVerify}) //nolint:gosec // opt-in via flag
+
+	c := &client{
+		log:                   log,
+		resty:                 r,
+		auth:                  auth,
+		endpoint:              endpoint,
+		insecureSkipTLSVerify: insecureSkipTLSVerify,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.metrics.install(c.resty)
+
+	return c
+}
+
+// GetAgentCerts fetches the NATS CA and JWT public key from the Upbound
+// gateway.
+func (c *client) GetAgentCerts(ctx context.Context) (PublicCerts, error) {
+	token, err := c.auth.Token(ctx)
+	if err != nil {
+		return PublicCerts{}, errors.Wrap(err, errRequestAgentCerts)
+	}
+
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetAuthToken(token).
+		Get(gwCertsPath)
+	if err != nil {
+		return PublicCerts{}, errors.Wrap(err, errRequestAgentCerts)
+	}
+
+	if resp.IsError() {
+		return PublicCerts{}, errors.Errorf(errFmtAgentCertsRequestFailed, resp.StatusCode(), string(resp.Body()))
+	}
+
+	out := map[string]string{}
+	if err := json.Unmarshal(resp.Body(), &out); err != nil {
+		c.metrics.recordError(gwCertsPath, ErrKindDecode)
+		return PublicCerts{}, errors.Wrap(err, errUnmarshalAgentCerts)
+	}
+
+	certs := PublicCerts{
+		NATSCA:       out[keyNATSCA],
+		JWTPublicKey: out[keyJWTPublicKey],
+	}
+
+	if certs.JWTPublicKey == "" {
+		c.metrics.recordError(gwCertsPath, ErrKindEmptyResponse)
+		return PublicCerts{}, errors.New(errEmptyJWTPublicKey)
+	}
+
+	c.log.Debug("fetched agent certs")
+
+	return certs, nil
+}
+
+// FetchNewJWTToken fetches a new NATS JWT for clusterID from the Upbound
+// gateway.
+func (c *client) FetchNewJWTToken(ctx context.Context, clusterID, publicKey string) (string, error) {
+	bearer, err := c.auth.Token(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, errRequestNewToken)
+	}
+
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetAuthToken(bearer).
+		SetBody(map[string]string{
+			"cluster_id": clusterID,
+			"public_key": publicKey,
+		}).
+		Post(natsTokenPath)
+	if err != nil {
+		return "", errors.Wrap(err, errRequestNewToken)
+	}
+
+	if resp.IsError() {
+		return "", errors.Errorf(errFmtNewTokenRequestFailed, resp.StatusCode(), string(resp.Body()))
+	}
+
+	out := map[string]string{}
+	if err := json.Unmarshal(resp.Body(), &out); err != nil {
+		c.metrics.recordError(natsTokenPath, ErrKindDecode)
+		return "", errors.Wrap(err, errUnmarshalNATSToken)
+	}
+
+	token := out[keyToken]
+	if token == "" {
+		c.metrics.recordError(natsTokenPath, ErrKindEmptyResponse)
+		return "", errors.New(errEmptyToken)
+	}
+
+	if expiresAt, err := jwtExpiry(token); err == nil {
+		c.metrics.observeJWTExpiry(clusterID, expiresAt)
+	}
+
+	c.log.Debug("fetched new nats token", "cluster_id", clusterID)
+
+	return token, nil
+}
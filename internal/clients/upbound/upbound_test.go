@@ -15,6 +15,7 @@
 package upbound
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/url"
@@ -107,7 +108,7 @@ func Test_GetAgentCerts(t *testing.T) {
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			rc := NewClient(endpoint, logging.NewNopLogger(), false, false)
+			rc := NewClient(endpoint, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator(endpointToken))
 
 			httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
 
@@ -125,7 +126,7 @@ func Test_GetAgentCerts(t *testing.T) {
 
 			httpmock.RegisterResponder(http.MethodGet, endpoint+gwCertsPath, responder)
 
-			got, gotErr := rc.GetAgentCerts(endpointToken)
+			got, gotErr := rc.GetAgentCerts(context.Background())
 			if diff := cmp.Diff(tc.want.err, gotErr, test.EquateErrors()); diff != "" {
 				t.Fatalf("GetAgentCerts(...): -want error, +got error: %s", diff)
 			}
@@ -214,7 +215,7 @@ func Test_fetchNewJWT(t *testing.T) {
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			rc := NewClient(endpoint, logging.NewNopLogger(), false, false)
+			rc := NewClient(endpoint, logging.NewNopLogger(), false, false, NewStaticTokenAuthenticator(endpointToken))
 
 			httpmock.ActivateNonDefault(rc.(*client).resty.GetClient())
 
@@ -232,7 +233,7 @@ func Test_fetchNewJWT(t *testing.T) {
 
 			httpmock.RegisterResponder(http.MethodPost, endpoint+natsTokenPath, responder)
 
-			got, gotErr := rc.FetchNewJWTToken(endpointToken, clusterID.String(), "some-public-key")
+			got, gotErr := rc.FetchNewJWTToken(context.Background(), clusterID.String(), "some-public-key")
 			if diff := cmp.Diff(tc.want.err, gotErr, test.EquateErrors()); diff != "" {
 				t.Fatalf("fetchNewJWTToken(...): -want error, +got error: %s", diff)
 			}